@@ -1,26 +1,240 @@
 package partial
 
 import (
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const blockSize int = 128 * 1024
 
+// defaultCacheSize bounds the default LRU block cache's memory footprint
+// when the caller doesn't specify one via WithCacheSize.
+const defaultCacheSize int64 = 256 * 1024 * 1024
+
+// Retry tuning for downloadRanges. These are deliberately conservative
+// defaults; transient 5xx responses, network errors and short reads are
+// retried with jittered exponential backoff, everything else is returned
+// immediately.
+const (
+	maxRetries     = 4
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 2 * time.Second
+	defaultTimeout = 30 * time.Second
+)
+
+// defaultConcurrency bounds how many range-fetch requests a single
+// downloadRanges call will have in flight at once when the caller doesn't
+// specify one via WithConcurrency.
+const defaultConcurrency = 4
+
+// errMultiRangeNotSupported is returned internally by fetchRanges when the
+// server declines to honor a multi-range request with a multipart
+// response; fetchRunWithRetry falls back to sequential single-range GETs
+// when it sees this.
+var errMultiRangeNotSupported = errors.New("partial: server does not support multi-range requests")
+
+// ErrRangeRequestsNotSupported is returned by NewPartialReaderAt when the
+// server never confirms it honors byte-range requests: the initial HEAD
+// did not answer 200 with a known Content-Length and
+// "Accept-Ranges: bytes", and the probing single-range GET did not
+// return 206 Partial Content.
+var ErrRangeRequestsNotSupported = errors.New("partial: server does not support range requests")
+
+// ErrResourceChanged is returned by ReadAt when a range GET sent with
+// If-Range comes back as 200 OK instead of 206 Partial Content, meaning
+// the resource's ETag/Last-Modified has changed since NewPartialReaderAt
+// observed it and the cache would otherwise be corrupted by mixing bytes
+// from two versions of the file.
+var ErrResourceChanged = errors.New("partial: resource changed since it was opened (If-Range validator stale)")
+
 type HTTPPartialReaderAt struct {
 	URL       *url.URL
 	Size      int64
 	blockSize int
 	client    *http.Client
-	blocks    map[int][]byte
+	cache     BlockCache
 	mutex     *sync.RWMutex
+	// Timeout bounds every HTTP request issued while fetching a block. A
+	// zero value means defaultTimeout applies.
+	Timeout time.Duration
+
+	// maxConcurrency caps how many range-fetch requests downloadRanges
+	// dispatches in parallel against this host; see WithConcurrency.
+	maxConcurrency int
+
+	// supportsRanges records whether an explicit "Accept-Ranges: bytes"
+	// header was observed during construction; see SupportsRanges.
+	supportsRanges bool
+	// ifRangeValue is sent as the If-Range header on every range GET, so
+	// a mid-stream mutation of the resource is detected as
+	// ErrResourceChanged rather than silently corrupting blocks.
+	ifRangeValue string
+
+	// readahead and prefetchWorkers configure speculative fetching of
+	// upcoming blocks on sequential access; see WithReadahead and
+	// WithPrefetchWorkers. Both default to 0 (disabled).
+	readahead       int
+	prefetchWorkers int
+	prefetchOnce    sync.Once
+	prefetchQueue   chan []requestByteRange
+	// prefetchDone signals the prefetch worker pool (if any) to stop;
+	// see stopPrefetch.
+	prefetchDone      chan struct{}
+	prefetchCloseOnce sync.Once
+	// lastBlock tracks the last block touched by ReadAt, used to detect
+	// sequential access. pending tracks blocks already queued or being
+	// fetched for readahead, so the same block isn't requested twice.
+	// Both are guarded by mutex.
+	lastBlock int
+	pending   map[int]bool
+}
+
+// BlockCache stores blocks fetched by HTTPPartialReaderAt so that ReadAt
+// doesn't need to re-fetch data it has already seen. ReadAt only ever
+// holds r.mutex's read lock while calling Get, so multiple goroutines
+// can be inside a BlockCache's methods at once; implementations must be
+// safe for concurrent use.
+type BlockCache interface {
+	// Get returns the cached data for block, if present. The returned
+	// slice must not be retained or mutated by the caller past the
+	// current call, since a future Put/Evict may reuse it.
+	Get(block int) ([]byte, bool)
+	// Put stores data for block, evicting other entries if necessary to
+	// stay within the cache's configured budget.
+	Put(block int, data []byte)
+	// Evict removes block from the cache, if present.
+	Evict(block int)
+}
+
+// Option configures an HTTPPartialReaderAt at construction time.
+type Option func(*HTTPPartialReaderAt)
+
+// WithCacheSize bounds the default LRU block cache to approximately
+// bytes of cached block data, evicting least-recently-used blocks once
+// the budget is exceeded. Options are applied in order, so whichever of
+// WithCacheSize and WithCache comes last decides the reader's cache.
+func WithCacheSize(bytes int64) Option {
+	return func(r *HTTPPartialReaderAt) {
+		r.cache = newLRUBlockCache(bytes)
+	}
+}
+
+// WithCache replaces the reader's block cache entirely, e.g. to share a
+// cache across readers or to disable caching.
+func WithCache(cache BlockCache) Option {
+	return func(r *HTTPPartialReaderAt) {
+		r.cache = cache
+	}
+}
+
+// WithConcurrency caps the number of range-fetch requests a single
+// downloadRanges call will have in flight at once. It defaults to
+// defaultConcurrency. The cap is not shared between calls: concurrent
+// ReadAt callers and readahead workers each get their own allowance.
+func WithConcurrency(n int) Option {
+	return func(r *HTTPPartialReaderAt) {
+		r.maxConcurrency = n
+	}
+}
+
+// WithReadahead enables speculative prefetching of up to blocks blocks
+// beyond the end of a ReadAt call, once sequential access is detected.
+// It has no effect unless combined with WithPrefetchWorkers.
+func WithReadahead(blocks int) Option {
+	return func(r *HTTPPartialReaderAt) {
+		r.readahead = blocks
+	}
+}
+
+// WithPrefetchWorkers sets the size of the background worker pool used
+// to service readahead fetches. It has no effect unless combined with
+// WithReadahead.
+func WithPrefetchWorkers(n int) Option {
+	return func(r *HTTPPartialReaderAt) {
+		r.prefetchWorkers = n
+	}
+}
+
+// lruBlockCache is the default BlockCache: an in-memory LRU bounded by
+// total bytes of cached block data rather than entry count, since blocks
+// near the end of a file can be shorter than blockSize. It has its own
+// mutex because Get is called under only r.mutex's shared read lock and
+// still mutates the LRU list on every hit.
+type lruBlockCache struct {
+	mutex     sync.Mutex
+	maxBytes  int64
+	usedBytes int64
+	ll        *list.List
+	items     map[int]*list.Element
+}
+
+type lruEntry struct {
+	block int
+	data  []byte
+}
+
+func newLRUBlockCache(maxBytes int64) *lruBlockCache {
+	return &lruBlockCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[int]*list.Element),
+	}
+}
+
+func (c *lruBlockCache) Get(block int) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	el, ok := c.items[block]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).data, true
+}
+
+func (c *lruBlockCache) Put(block int, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el, ok := c.items[block]; ok {
+		c.usedBytes += int64(len(data)) - int64(len(el.Value.(*lruEntry).data))
+		el.Value.(*lruEntry).data = data
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[block] = c.ll.PushFront(&lruEntry{block: block, data: data})
+		c.usedBytes += int64(len(data))
+	}
+
+	for c.maxBytes > 0 && c.usedBytes > c.maxBytes && c.ll.Len() > 0 {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *lruBlockCache) Evict(block int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el, ok := c.items[block]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lruBlockCache) removeElement(el *list.Element) {
+	entry := el.Value.(*lruEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.block)
+	c.usedBytes -= int64(len(entry.data))
 }
 
 type requestByteRange struct {
@@ -32,46 +246,409 @@ func (r requestByteRange) String() string {
 	return fmt.Sprintf("%d-%d", r.start, r.end)
 }
 
-func (r *HTTPPartialReaderAt) readRangeIntoBlock(rng requestByteRange, reader io.Reader) {
+// readRangeIntoBlock reads rng's bytes from reader into a local buffer
+// and only then takes the mutex to store it, so the lock is never held
+// across network I/O.
+func (r *HTTPPartialReaderAt) readRangeIntoBlock(rng requestByteRange, reader io.Reader) error {
 	bn := rng.block
 	blocklen := (rng.end - rng.start) + 1
-	r.blocks[bn] = make([]byte, blocklen)
-	io.ReadFull(reader, r.blocks[bn])
+	buf := make([]byte, blocklen)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return fmt.Errorf("partial: reading block %d: %w", bn, err)
+	}
+	r.mutex.Lock()
+	r.cache.Put(bn, buf)
+	r.mutex.Unlock()
+	return nil
+}
+
+// retryableError marks an error as a transient failure worth retrying,
+// such as a 5xx response.
+type retryableError struct{ err error }
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
+// isRetryable reports whether err represents a transient failure worth
+// retrying: a retryableError, network error, or short read all qualify.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var re retryableError
+	if errors.As(err, &re) {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// backoff returns how long to wait before retry attempt n (0-indexed),
+// with jitter to avoid synchronized retries from multiple readers.
+func backoff(n int) time.Duration {
+	d := retryBaseDelay << uint(n)
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
 
-func (r *HTTPPartialReaderAt) downloadRanges(ranges []requestByteRange) {
-	if len(ranges) > 0 {
-		rs := make([]string, len(ranges))
-		for i, rng := range ranges {
-			rs[i] = rng.String()
+// doRangeRequest issues a single Range GET/HEAD-free request for
+// rangeHeader (the value of the Range header, possibly comma-joined for
+// a multi-range request) and returns the response, having already
+// validated that the server answered with 206. It does not check the
+// Content-Range; fetchRanges does that.
+func (r *HTTPPartialReaderAt) doRangeRequest(ctx context.Context, rangeHeader string, multi bool) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", r.URL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("partial: building request: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%s", rangeHeader))
+	if r.ifRangeValue != "" {
+		req.Header.Set("If-Range", r.ifRangeValue)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if multi && resp.StatusCode == http.StatusOK {
+			// The server doesn't support multi-range requests and sent
+			// the whole resource back as a single 200; the caller falls
+			// back to sequential single-range GETs. This isn't a stale
+			// If-Range validator — nothing changed, the server just
+			// doesn't understand the range syntax we sent.
+			return nil, errMultiRangeNotSupported
+		}
+		if r.ifRangeValue != "" && resp.StatusCode == http.StatusOK {
+			return nil, ErrResourceChanged
 		}
-		rangeString := strings.Join(rs, ",")
+		if resp.StatusCode >= 500 {
+			return nil, retryableError{fmt.Errorf("partial: server returned %s for range %s", resp.Status, rangeHeader)}
+		}
+		return nil, fmt.Errorf("partial: server does not support range requests (got %s)", resp.Status)
+	}
 
-		req, _ := http.NewRequest("GET", r.URL.String(), nil)
-		req.Header["Range"] = []string{fmt.Sprintf("bytes=%s", rangeString)}
+	return resp, nil
+}
 
-		resp, _ := r.client.Do(req)
-		typ, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
-		defer resp.Body.Close()
+// fetchRanges issues one request covering all of ranges and writes the
+// results into the cache. It reports errMultiRangeNotSupported if the
+// server answered a multi-range request with something other than a
+// multipart/byteranges body, so the caller can fall back to sequential
+// single-range requests.
+func (r *HTTPPartialReaderAt) fetchRanges(ctx context.Context, ranges []requestByteRange) error {
+	rs := make([]string, len(ranges))
+	for i, rng := range ranges {
+		rs[i] = rng.String()
+	}
+	rangeString := strings.Join(rs, ",")
 
-		if typ == "multipart/byteranges" {
-			multipart := multipart.NewReader(resp.Body, params["boundary"])
-			r.mutex.Lock()
-			i := 0
-			for {
-				if part, err := multipart.NextPart(); err == nil {
-					r.readRangeIntoBlock(ranges[i], part)
-					i++
-				} else {
-					break
+	resp, err := r.doRangeRequest(ctx, rangeString, len(ranges) > 1)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if len(ranges) == 1 {
+		if err := r.validateContentRange(resp, ranges[0]); err != nil {
+			return err
+		}
+		return r.readRangeIntoBlock(ranges[0], resp.Body)
+	}
+
+	typ, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if typ != "multipart/byteranges" {
+		return errMultiRangeNotSupported
+	}
+
+	// Match each part to the range it actually claims to be, by its own
+	// Content-Range, rather than assuming the server returned parts in
+	// request order: a part written into the wrong block on a purely
+	// positional match would silently corrupt the cache.
+	want := make(map[string]requestByteRange, len(ranges))
+	for _, rng := range ranges {
+		want[rng.String()] = rng
+	}
+
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for i := range ranges {
+		part, err := mr.NextPart()
+		if err != nil {
+			return fmt.Errorf("partial: reading multipart range %d of %d: %w", i+1, len(ranges), err)
+		}
+		key, ok := parseContentRangeStartEnd(part.Header.Get("Content-Range"))
+		if !ok {
+			return fmt.Errorf("partial: multipart range %d of %d: missing or malformed Content-Range %q", i+1, len(ranges), part.Header.Get("Content-Range"))
+		}
+		rng, ok := want[key]
+		if !ok {
+			return fmt.Errorf("partial: multipart range %d of %d: unrequested Content-Range %q", i+1, len(ranges), part.Header.Get("Content-Range"))
+		}
+		delete(want, key)
+		if err := r.readRangeIntoBlock(rng, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateContentRange checks that a single-range 206 response actually
+// covers the range that was requested.
+func (r *HTTPPartialReaderAt) validateContentRange(resp *http.Response, rng requestByteRange) error {
+	cr := resp.Header.Get("Content-Range")
+	want := fmt.Sprintf("bytes %d-%d/", rng.start, rng.end)
+	if !strings.HasPrefix(cr, want) && cr != fmt.Sprintf("bytes %d-%d/*", rng.start, rng.end) {
+		return fmt.Errorf("partial: unexpected Content-Range %q for requested range %s", cr, rng)
+	}
+	return nil
+}
+
+// parseContentRangeStartEnd extracts the "start-end" portion from a
+// "Content-Range: bytes start-end/total" header value, which is also
+// what requestByteRange.String() produces — letting callers match a
+// response part back to the range it actually covers.
+func parseContentRangeStartEnd(contentRange string) (string, bool) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(contentRange, prefix) {
+		return "", false
+	}
+	rest := contentRange[len(prefix):]
+	slash := strings.IndexByte(rest, '/')
+	if slash < 0 {
+		return "", false
+	}
+	return rest[:slash], true
+}
+
+// fetchRunWithRetry fetches a single contiguous run of ranges, retrying
+// transient failures with exponential backoff and, if the server refuses
+// a multi-range request, falling back to one sequential single-range GET
+// per block in the run.
+func (r *HTTPPartialReaderAt) fetchRunWithRetry(ctx context.Context, run []requestByteRange) error {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	fetch := func(rngs []requestByteRange) error {
+		var lastErr error
+		for attempt := 0; attempt <= maxRetries; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(backoff(attempt - 1)):
 				}
 			}
-			r.mutex.Unlock()
-		} else {
+			reqCtx, cancel := context.WithTimeout(ctx, timeout)
+			err := r.fetchRanges(reqCtx, rngs)
+			cancel()
+			if err == nil {
+				return nil
+			}
+			if errors.Is(err, errMultiRangeNotSupported) || errors.Is(err, context.Canceled) {
+				return err
+			}
+			lastErr = err
+			if !isRetryable(err) {
+				return err
+			}
+		}
+		return fmt.Errorf("partial: giving up after %d retries: %w", maxRetries, lastErr)
+	}
+
+	if err := fetch(run); err != nil {
+		if !errors.Is(err, errMultiRangeNotSupported) {
+			return err
+		}
+		// Server won't do multi-range; fall back to one request per block.
+		for _, rng := range run {
+			if err := fetch([]requestByteRange{rng}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// coalesceRuns groups a block-ascending range list into maximal runs of
+// consecutive blocks, so each run can be requested as a single multipart
+// GET instead of one request per block.
+func coalesceRuns(ranges []requestByteRange) [][]requestByteRange {
+	var runs [][]requestByteRange
+	start := 0
+	for i := 1; i <= len(ranges); i++ {
+		if i == len(ranges) || ranges[i].block != ranges[i-1].block+1 {
+			runs = append(runs, ranges[start:i])
+			start = i
+		}
+	}
+	return runs
+}
+
+// downloadRanges fetches the given blocks from the server, storing them
+// in the cache. Runs of contiguous blocks are dispatched to up to
+// maxConcurrency parallel workers against this host, each merging its
+// run into one multipart request; a failure in any worker cancels the
+// others via ctx.
+func (r *HTTPPartialReaderAt) downloadRanges(ranges []requestByteRange) error {
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	runs := coalesceRuns(ranges)
+
+	concurrency := r.maxConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	if concurrency > len(runs) {
+		concurrency = len(runs)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	for _, run := range runs {
+		run := run
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := r.fetchRunWithRetry(ctx, run); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// ensurePrefetchWorkers lazily starts the readahead worker pool the first
+// time it's needed, sized by prefetchWorkers.
+func (r *HTTPPartialReaderAt) ensurePrefetchWorkers() {
+	r.prefetchOnce.Do(func() {
+		if r.prefetchWorkers <= 0 {
+			return
+		}
+		r.prefetchQueue = make(chan []requestByteRange, r.prefetchWorkers*2)
+		for i := 0; i < r.prefetchWorkers; i++ {
+			go r.prefetchWorker()
+		}
+	})
+}
+
+// prefetchWorker services readahead requests queued by maybePrefetch,
+// coalescing each batch into a single downloadRanges call. Fetch errors
+// are dropped: a later synchronous ReadAt for the same block will retry.
+// It exits once stopPrefetch closes prefetchDone.
+func (r *HTTPPartialReaderAt) prefetchWorker() {
+	for {
+		select {
+		case ranges, ok := <-r.prefetchQueue:
+			if !ok {
+				return
+			}
+			r.downloadRanges(ranges)
 			r.mutex.Lock()
-			r.readRangeIntoBlock(ranges[0], resp.Body)
+			for _, rng := range ranges {
+				delete(r.pending, rng.block)
+			}
 			r.mutex.Unlock()
+		case <-r.prefetchDone:
+			return
+		}
+	}
+}
+
+// stopPrefetch shuts down the background prefetch worker pool started
+// by ensurePrefetchWorkers, if any. Safe to call even if readahead was
+// never enabled, and safe to call more than once.
+func (r *HTTPPartialReaderAt) stopPrefetch() {
+	r.prefetchCloseOnce.Do(func() {
+		close(r.prefetchDone)
+	})
+}
+
+// maybePrefetch speculatively schedules the next r.readahead blocks
+// after endBlock for background fetching, if the read at [block,
+// endBlock] looks like part of a sequential scan.
+func (r *HTTPPartialReaderAt) maybePrefetch(block, endBlock int) {
+	if r.readahead <= 0 || r.prefetchWorkers <= 0 {
+		return
+	}
+
+	r.mutex.Lock()
+	sequential := block <= r.lastBlock+1
+	r.lastBlock = endBlock
+	if !sequential {
+		r.mutex.Unlock()
+		return
+	}
+
+	var ranges []requestByteRange
+	for i := 1; i <= r.readahead; i++ {
+		bn := endBlock + i
+		start := int64(bn * r.blockSize)
+		if start >= r.Size {
+			break
 		}
+		if _, ok := r.cache.Get(bn); ok {
+			continue
+		}
+		if r.pending[bn] {
+			continue
+		}
+		end := int64(((bn + 1) * r.blockSize) - 1)
+		if end > r.Size-1 {
+			end = r.Size - 1
+		}
+		r.pending[bn] = true
+		ranges = append(ranges, requestByteRange{bn, start, end})
+	}
+	r.mutex.Unlock()
+
+	if len(ranges) == 0 {
+		return
+	}
+
+	r.ensurePrefetchWorkers()
+
+	select {
+	case r.prefetchQueue <- ranges:
+	case <-r.prefetchDone:
+		// Workers have been shut down; drop this round.
+		r.mutex.Lock()
+		for _, rng := range ranges {
+			delete(r.pending, rng.block)
+		}
+		r.mutex.Unlock()
+	default:
+		// Worker pool is saturated; drop this round rather than
+		// blocking the caller's ReadAt on readahead.
+		r.mutex.Lock()
+		for _, rng := range ranges {
+			delete(r.pending, rng.block)
+		}
+		r.mutex.Unlock()
 	}
 }
 
@@ -90,16 +667,16 @@ func (r *HTTPPartialReaderAt) ReadAt(p []byte, off int64) (int, error) {
 	r.mutex.RLock()
 	for i := 0; i < nblocks; i++ {
 		bn := block + i
-		if _, ok := r.blocks[bn]; ok {
+		if _, ok := r.cache.Get(bn); ok {
 			continue
 		}
-		ranges[i] = requestByteRange{
+		ranges[nreq] = requestByteRange{
 			bn,
 			int64(bn * r.blockSize),
 			int64(((bn + 1) * r.blockSize) - 1),
 		}
-		if ranges[i].end > r.Size {
-			ranges[i].end = r.Size
+		if ranges[nreq].end > r.Size-1 {
+			ranges[nreq].end = r.Size - 1
 		}
 
 		nreq++
@@ -107,7 +684,15 @@ func (r *HTTPPartialReaderAt) ReadAt(p []byte, off int64) (int, error) {
 	r.mutex.RUnlock()
 	ranges = ranges[:nreq]
 
-	r.downloadRanges(ranges)
+	lastBlockTouched := endBlock
+	if endBlockOff == 0 {
+		lastBlockTouched--
+	}
+	r.maybePrefetch(block, lastBlockTouched)
+
+	if err := r.downloadRanges(ranges); err != nil {
+		return 0, err
+	}
 	return r.copyRangeToBuffer(p, off)
 }
 
@@ -117,6 +702,7 @@ func (r *HTTPPartialReaderAt) copyRangeToBuffer(p []byte, off int64) (int, error
 	startOffset := off % int64(r.blockSize)
 	ncopied := 0
 	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 	for remaining > 0 {
 		copylen := r.blockSize
 		if copylen > remaining {
@@ -128,10 +714,11 @@ func (r *HTTPPartialReaderAt) copyRangeToBuffer(p []byte, off int64) (int, error
 			copylen = int(int64(r.blockSize) - startOffset)
 		}
 
-		if _, ok := r.blocks[block]; !ok {
-			return 0, errors.New("fu?")
+		data, ok := r.cache.Get(block)
+		if !ok {
+			return ncopied, fmt.Errorf("partial: block %d missing after download", block)
 		}
-		copy(p[ncopied:ncopied+copylen], r.blocks[block][startOffset:])
+		copy(p[ncopied:ncopied+copylen], data[startOffset:])
 
 		remaining -= copylen
 		ncopied += copylen
@@ -139,25 +726,200 @@ func (r *HTTPPartialReaderAt) copyRangeToBuffer(p []byte, off int64) (int, error
 		block++
 		startOffset = 0
 	}
-	r.mutex.RUnlock()
 
 	return ncopied, nil
 }
 
-func NewPartialReaderAt(u *url.URL) (*HTTPPartialReaderAt, error) {
-	resp, _ := http.Head(u.String())
+// parseContentRangeTotal extracts the total resource size from a
+// "Content-Range: bytes start-end/total" header value, as returned by a
+// GET with a "Range: bytes=0-0" probe request.
+func parseContentRangeTotal(contentRange string) (int64, bool) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(contentRange, prefix) {
+		return 0, false
+	}
+	parts := strings.SplitN(contentRange[len(prefix):], "/", 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+	total, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return total, true
+}
+
+// probeSize issues a "Range: bytes=0-0" GET, used when HEAD fails or
+// doesn't give us what we need: some CDNs and object stores reject HEAD
+// outright, report ContentLength -1 for chunked responses, or simply
+// don't confirm Accept-Ranges on a HEAD the way they do on a real range
+// GET. acceptRanges reports whether the probe response itself carried an
+// explicit "Accept-Ranges: bytes" header, as opposed to range support
+// being merely inferred from the 206 status; see SupportsRanges.
+func probeSize(client *http.Client, u *url.URL) (size int64, etag, lastModified string, acceptRanges bool, err error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return 0, "", "", false, fmt.Errorf("partial: building probe request: %w", err)
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", "", false, fmt.Errorf("partial: probing %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+
 	if resp.StatusCode == http.StatusNotFound {
-		return nil, errors.New("404")
+		return 0, "", "", false, errors.New("404")
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, "", "", false, ErrRangeRequestsNotSupported
 	}
 
-	return &HTTPPartialReaderAt{
-		URL:       u,
-		Size:      resp.ContentLength,
-		blockSize: blockSize,
-		client:    &http.Client{},
-		blocks:    make(map[int][]byte),
-		mutex:     &sync.RWMutex{},
-	}, nil
+	total, ok := parseContentRangeTotal(resp.Header.Get("Content-Range"))
+	if !ok {
+		return 0, "", "", false, fmt.Errorf("partial: could not parse Content-Range %q", resp.Header.Get("Content-Range"))
+	}
+
+	return total, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), resp.Header.Get("Accept-Ranges") == "bytes", nil
+}
+
+func NewPartialReaderAt(u *url.URL, opts ...Option) (*HTTPPartialReaderAt, error) {
+	client := &http.Client{}
+
+	var size int64
+	var etag, lastModified string
+	var acceptRanges bool
+
+	resp, err := client.Head(u.String())
+	if err == nil {
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return nil, errors.New("404")
+		}
+		if resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 && resp.Header.Get("Accept-Ranges") == "bytes" {
+			size = resp.ContentLength
+			etag = resp.Header.Get("ETag")
+			lastModified = resp.Header.Get("Last-Modified")
+			acceptRanges = true
+			resp.Body.Close()
+		} else {
+			resp.Body.Close()
+			err = ErrRangeRequestsNotSupported
+		}
+	}
+
+	// HEAD failed, was rejected, or didn't confirm Accept-Ranges; fall
+	// back to probing with a single-byte range GET, as seaweedfs'
+	// ChunkedFileReader does.
+	if err != nil {
+		size, etag, lastModified, acceptRanges, err = probeSize(client, u)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := &HTTPPartialReaderAt{
+		URL:            u,
+		Size:           size,
+		blockSize:      blockSize,
+		client:         client,
+		cache:          newLRUBlockCache(defaultCacheSize),
+		mutex:          &sync.RWMutex{},
+		lastBlock:      -1,
+		pending:        make(map[int]bool),
+		supportsRanges: acceptRanges,
+		prefetchDone:   make(chan struct{}),
+	}
+	if etag != "" {
+		r.ifRangeValue = etag
+	} else {
+		r.ifRangeValue = lastModified
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r, nil
+}
+
+// SupportsRanges reports whether the server sent an explicit
+// "Accept-Ranges: bytes" header — on the initial HEAD, or on the
+// bytes=0-0 probe GET used when HEAD doesn't confirm it. A reader can
+// still have been constructed successfully with this false: a 206 to the
+// probe GET is enough to proceed even without the header, since it's
+// direct proof the request just made was honored.
+func (r *HTTPPartialReaderAt) SupportsRanges() bool {
+	return r.supportsRanges
+}
+
+// NewSectionReader returns an io.SectionReader over r spanning n bytes
+// starting at off, for consumers that already know the region they want
+// to stream (e.g. a zip central directory entry).
+func NewSectionReader(r *HTTPPartialReaderAt, off, n int64) *io.SectionReader {
+	return io.NewSectionReader(r, off, n)
+}
+
+// Reader adapts an HTTPPartialReaderAt into an io.ReadSeekCloser with a
+// maintained read position, for consumers that want a stream rather than
+// random access, such as archive/tar and mime sniffing. Reader has no
+// ReadAt method, so archive/zip.NewReader takes the HTTPPartialReaderAt
+// itself rather than a Reader.
+type Reader struct {
+	r   *HTTPPartialReaderAt
+	pos int64
+}
+
+var _ io.ReadSeekCloser = (*Reader)(nil)
+
+// NewReader wraps r as an io.ReadSeekCloser starting at position 0.
+func NewReader(r *HTTPPartialReaderAt) *Reader {
+	return &Reader{r: r}
+}
+
+func (s *Reader) Read(p []byte) (int, error) {
+	remaining := s.r.Size - s.pos
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := s.r.ReadAt(p, s.pos)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *Reader) Seek(offset int64, whence int) (int64, error) {
+	var newPos int64
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos = s.pos + offset
+	case io.SeekEnd:
+		newPos = s.r.Size + offset
+	default:
+		return 0, fmt.Errorf("partial: Seek: invalid whence %d", whence)
+	}
+	if newPos < 0 {
+		return 0, fmt.Errorf("partial: Seek: negative position %d", newPos)
+	}
+	s.pos = newPos
+	return s.pos, nil
+}
+
+// Close stops any background prefetch workers, releases the reader's
+// cached blocks, and closes the underlying HTTP client's idle
+// connections. The Reader must not be used after Close.
+func (s *Reader) Close() error {
+	s.r.stopPrefetch()
+	s.r.mutex.Lock()
+	s.r.cache = newLRUBlockCache(0)
+	s.r.mutex.Unlock()
+	s.r.client.CloseIdleConnections()
+	return nil
 }
 
 type LoggingReaderAt struct {
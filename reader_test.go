@@ -0,0 +1,672 @@
+package partial
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func mustURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("parse %q: %v", s, err)
+	}
+	return u
+}
+
+// fillTestData deterministically fills buf so ReadAt results can be
+// checked for correctness, not just for success/failure.
+func fillTestData(buf []byte) {
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+}
+
+type testByteRange struct {
+	start, end int64
+}
+
+// parseRangeHeader parses a "bytes=a-b,c-d" Range header value into the
+// byte ranges it names, clamped to size.
+func parseRangeHeader(header string, size int64) ([]testByteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, fmt.Errorf("unsupported Range header %q", header)
+	}
+	specs := strings.Split(header[len(prefix):], ",")
+	ranges := make([]testByteRange, 0, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "-", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed range %q", spec)
+		}
+		start, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed range %q: %w", spec, err)
+		}
+		end, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed range %q: %w", spec, err)
+		}
+		if end >= size {
+			end = size - 1
+		}
+		ranges = append(ranges, testByteRange{start, end})
+	}
+	return ranges, nil
+}
+
+// rangeHandler returns an http.HandlerFunc that serves data out of an
+// in-memory byte slice, honoring HEAD, single-range, and multi-range
+// (multipart/byteranges) GETs the way a well-behaved origin would.
+func rangeHandler(data []byte, etag string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+
+		if r.Method == http.MethodHead {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		rangeHeader := r.Header.Get("Range")
+		if rangeHeader == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+			return
+		}
+
+		ranges, err := parseRangeHeader(rangeHeader, int64(len(data)))
+		if err != nil {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		if len(ranges) == 1 {
+			rg := ranges[0]
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rg.start, rg.end, len(data)))
+			w.Header().Set("Content-Length", strconv.FormatInt(rg.end-rg.start+1, 10))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[rg.start : rg.end+1])
+			return
+		}
+
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.WriteHeader(http.StatusPartialContent)
+		for _, rg := range ranges {
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", rg.start, rg.end, len(data))},
+			})
+			if err != nil {
+				return
+			}
+			part.Write(data[rg.start : rg.end+1])
+		}
+		mw.Close()
+	}
+}
+
+// TestReadAtRetriesTransientFailures checks that a handful of 5xx
+// responses are retried rather than propagated as a permanent error.
+func TestReadAtRetriesTransientFailures(t *testing.T) {
+	data := make([]byte, blockSize)
+	fillTestData(data)
+
+	var gets int32
+	base := rangeHandler(data, "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && atomic.AddInt32(&gets, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		base(w, r)
+	}))
+	defer srv.Close()
+
+	r, err := NewPartialReaderAt(mustURL(t, srv.URL))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+
+	buf := make([]byte, len(data))
+	n, err := r.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if n != len(data) || !bytes.Equal(buf, data) {
+		t.Fatalf("ReadAt returned wrong data after retries")
+	}
+}
+
+// TestReadAtGivesUpAfterExhaustingRetries checks that a server that
+// never recovers is reported as an error rather than hanging or
+// returning corrupt data.
+func TestReadAtGivesUpAfterExhaustingRetries(t *testing.T) {
+	data := make([]byte, blockSize)
+	fillTestData(data)
+
+	base := rangeHandler(data, "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		base(w, r)
+	}))
+	defer srv.Close()
+
+	r, err := NewPartialReaderAt(mustURL(t, srv.URL))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+
+	buf := make([]byte, len(data))
+	if _, err := r.ReadAt(buf, 0); err == nil {
+		t.Fatalf("ReadAt: expected an error from a server that never recovers")
+	}
+}
+
+// TestReadAtFallsBackWhenMultiRangeUnsupported checks that a server
+// which answers a multi-range GET with a single 200 (ignoring the Range
+// header) is retried as sequential single-range GETs rather than
+// misread as a stale If-Range validator.
+func TestReadAtFallsBackWhenMultiRangeUnsupported(t *testing.T) {
+	data := make([]byte, 2*blockSize)
+	fillTestData(data)
+
+	// Serve an ETag so every range GET carries an If-Range validator.
+	base := rangeHandler(data, "v1")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Range"), ",") {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+			return
+		}
+		base(w, r)
+	}))
+	defer srv.Close()
+
+	r, err := NewPartialReaderAt(mustURL(t, srv.URL))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+
+	buf := make([]byte, len(data))
+	n, err := r.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if n != len(data) || !bytes.Equal(buf, data) {
+		t.Fatalf("ReadAt returned wrong data after multi-range fallback")
+	}
+}
+
+// TestFetchRangesPlacesMisorderedMultipartPartsByContentRange checks that
+// a multipart/byteranges response whose parts arrive in a different order
+// than requested is stored by each part's own Content-Range instead of
+// being written into the wrong block by position.
+func TestFetchRangesPlacesMisorderedMultipartPartsByContentRange(t *testing.T) {
+	data := make([]byte, 2*blockSize)
+	fillTestData(data)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			rangeHandler(data, "")(w, r)
+			return
+		}
+
+		ranges, err := parseRangeHeader(r.Header.Get("Range"), int64(len(data)))
+		if err != nil || len(ranges) != 2 {
+			rangeHandler(data, "")(w, r)
+			return
+		}
+
+		// Reverse the order the parts are written in, each still
+		// carrying its own (now mismatched-by-position) Content-Range.
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.WriteHeader(http.StatusPartialContent)
+		for i := len(ranges) - 1; i >= 0; i-- {
+			rg := ranges[i]
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", rg.start, rg.end, len(data))},
+			})
+			if err != nil {
+				return
+			}
+			part.Write(data[rg.start : rg.end+1])
+		}
+		mw.Close()
+	}))
+	defer srv.Close()
+
+	r, err := NewPartialReaderAt(mustURL(t, srv.URL))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+
+	buf := make([]byte, len(data))
+	n, err := r.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if n != len(data) || !bytes.Equal(buf, data) {
+		t.Fatalf("ReadAt returned wrong data (n=%d) for out-of-order multipart parts", n)
+	}
+}
+
+// TestLRUBlockCacheEvictsLeastRecentlyUsed checks that the cache stays
+// within its byte budget by evicting the least recently touched block,
+// and that touching a block via Get protects it from the next eviction.
+func TestLRUBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUBlockCache(int64(2 * blockSize))
+
+	block0 := bytes.Repeat([]byte{0}, blockSize)
+	block1 := bytes.Repeat([]byte{1}, blockSize)
+	block2 := bytes.Repeat([]byte{2}, blockSize)
+
+	c.Put(0, block0)
+	c.Put(1, block1)
+
+	// Touch block 0 so block 1 becomes the least recently used entry.
+	if _, ok := c.Get(0); !ok {
+		t.Fatalf("Get(0): expected a cache hit before eviction")
+	}
+
+	c.Put(2, block2)
+
+	if _, ok := c.Get(1); ok {
+		t.Fatalf("Get(1): expected block 1 to have been evicted")
+	}
+	if _, ok := c.Get(0); !ok {
+		t.Fatalf("Get(0): expected block 0 to survive eviction (recently touched)")
+	}
+	if data, ok := c.Get(2); !ok || !bytes.Equal(data, block2) {
+		t.Fatalf("Get(2): expected the newly inserted block to be present")
+	}
+}
+
+// TestLRUBlockCacheEvict checks that an explicit Evict removes the
+// block regardless of recency.
+func TestLRUBlockCacheEvict(t *testing.T) {
+	c := newLRUBlockCache(defaultCacheSize)
+	c.Put(0, []byte("data"))
+	c.Evict(0)
+	if _, ok := c.Get(0); ok {
+		t.Fatalf("Get(0): expected block to be gone after Evict")
+	}
+}
+
+// TestLRUBlockCacheConcurrentAccess exercises Get/Put/Evict from many
+// goroutines at once under only the cache's own mutex, the way ReadAt
+// and copyRangeToBuffer call it while holding just the reader's shared
+// RLock. It does not assert anything about outcomes beyond "no panic,
+// no hang" — its value is as a `go test -race` target for the data race
+// that this package used to have.
+func TestLRUBlockCacheConcurrentAccess(t *testing.T) {
+	c := newLRUBlockCache(int64(4 * blockSize))
+	data := bytes.Repeat([]byte{0xAB}, blockSize)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				block := (g + i) % 6
+				c.Put(block, data)
+				c.Get(block)
+				if i%10 == 0 {
+					c.Evict(block)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// TestReadAtPrefetchesAhead checks that sequential access triggers a
+// background readahead fetch, so a subsequent read for the next block
+// is served from cache without forcing the caller to wait on a new
+// request of its own.
+func TestReadAtPrefetchesAhead(t *testing.T) {
+	// Three blocks, so the readahead of blocks 1-2 covers the rest of the
+	// file and the second ReadAt has nothing left to prefetch in the
+	// background that could be counted as a GET of its own.
+	data := make([]byte, 3*blockSize)
+	fillTestData(data)
+
+	var gets int32
+	base := rangeHandler(data, "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+		}
+		base(w, r)
+	}))
+	defer srv.Close()
+
+	r, err := NewPartialReaderAt(mustURL(t, srv.URL), WithReadahead(2), WithPrefetchWorkers(1))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+
+	buf := make([]byte, blockSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt(0): %v", err)
+	}
+
+	// The readahead fetch for blocks 1-2 runs on a background worker;
+	// give it a moment to land in the cache.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := r.cache.Get(1); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for block 1 to be prefetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	getsBeforeSecondRead := atomic.LoadInt32(&gets)
+
+	if _, err := r.ReadAt(buf, int64(blockSize)); err != nil {
+		t.Fatalf("ReadAt(blockSize): %v", err)
+	}
+	if !bytes.Equal(buf, data[blockSize:2*blockSize]) {
+		t.Fatalf("ReadAt(blockSize): wrong data")
+	}
+	if atomic.LoadInt32(&gets) != getsBeforeSecondRead {
+		t.Fatalf("ReadAt(blockSize) issued a new GET instead of reading the prefetched block from cache")
+	}
+}
+
+// TestReaderReadSeekClose checks the io.ReadSeekCloser semantics of
+// Reader: sequential Read, all three Seek whences, and that Close
+// drops the cache rather than erroring.
+func TestReaderReadSeekClose(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	srv := httptest.NewServer(rangeHandler(data, ""))
+	defer srv.Close()
+
+	pr, err := NewPartialReaderAt(mustURL(t, srv.URL))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+	rd := NewReader(pr)
+
+	buf := make([]byte, 9)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf) != "the quick" {
+		t.Fatalf("Read: got %q, want %q", buf, "the quick")
+	}
+
+	if pos, err := rd.Seek(6, io.SeekStart); err != nil || pos != 6 {
+		t.Fatalf("Seek(SeekStart): pos=%d err=%v", pos, err)
+	}
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		t.Fatalf("Read after SeekStart: %v", err)
+	}
+	if string(buf) != "ick brown" {
+		t.Fatalf("Read after SeekStart: got %q, want %q", buf, "ick brown")
+	}
+
+	if pos, err := rd.Seek(-9, io.SeekCurrent); err != nil || pos != 6 {
+		t.Fatalf("Seek(SeekCurrent): pos=%d err=%v", pos, err)
+	}
+	if pos, err := rd.Seek(-3, io.SeekEnd); err != nil || pos != int64(len(data))-3 {
+		t.Fatalf("Seek(SeekEnd): pos=%d err=%v", pos, err)
+	}
+	tail := make([]byte, 3)
+	if _, err := io.ReadFull(rd, tail); err != nil {
+		t.Fatalf("Read after SeekEnd: %v", err)
+	}
+	if string(tail) != "dog" {
+		t.Fatalf("Read after SeekEnd: got %q, want %q", tail, "dog")
+	}
+
+	if err := rd.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, ok := pr.cache.Get(0); ok {
+		t.Fatalf("Close: block 0 still cached, want the cache dropped")
+	}
+}
+
+// TestNewSectionReader checks that NewSectionReader restricts reads to
+// the given window of the underlying resource.
+func TestNewSectionReader(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+
+	srv := httptest.NewServer(rangeHandler(data, ""))
+	defer srv.Close()
+
+	pr, err := NewPartialReaderAt(mustURL(t, srv.URL))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+
+	sr := NewSectionReader(pr, 5, 5)
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sr, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf) != "56789" {
+		t.Fatalf("Read: got %q, want %q", buf, "56789")
+	}
+
+	n, err := sr.Read(buf)
+	if n != 0 || err != io.EOF {
+		t.Fatalf("Read past section end: n=%d err=%v, want 0, io.EOF", n, err)
+	}
+}
+
+// TestDownloadRangesRunsConcurrently checks that separate
+// non-contiguous block runs are dispatched to the worker pool in
+// parallel rather than one at a time.
+func TestDownloadRangesRunsConcurrently(t *testing.T) {
+	data := make([]byte, 4*blockSize)
+	fillTestData(data)
+
+	var inFlight, maxInFlight int32
+	base := rangeHandler(data, "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			base(w, r)
+			return
+		}
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			old := atomic.LoadInt32(&maxInFlight)
+			if n <= old || atomic.CompareAndSwapInt32(&maxInFlight, old, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		base(w, r)
+	}))
+	defer srv.Close()
+
+	r, err := NewPartialReaderAt(mustURL(t, srv.URL), WithConcurrency(2))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+
+	// Pre-populate the middle two blocks so the still-uncached blocks
+	// (0 and 3) form two separate, non-contiguous runs that have to be
+	// dispatched as independent requests.
+	r.cache.Put(1, data[blockSize:2*blockSize])
+	r.cache.Put(2, data[2*blockSize:3*blockSize])
+
+	buf := make([]byte, len(data))
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("ReadAt returned wrong data")
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got < 2 {
+		t.Fatalf("expected independent runs to be fetched concurrently, max in-flight GETs = %d", got)
+	}
+}
+
+// TestDownloadRangesCancelsSiblingsOnHardError checks that a run which
+// exhausts its retries against a permanently failing server doesn't
+// leave the other run's request dangling — downloadRanges should
+// return once the hard failure is known rather than waiting out every
+// other in-flight run first.
+func TestDownloadRangesCancelsSiblingsOnHardError(t *testing.T) {
+	data := make([]byte, 4*blockSize)
+	fillTestData(data)
+
+	base := rangeHandler(data, "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			ranges, err := parseRangeHeader(r.Header.Get("Range"), int64(len(data)))
+			if err == nil && len(ranges) == 1 && ranges[0].start == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			// Stall block 3's run until its request is cancelled, so
+			// ReadAt only returns promptly if the failing run cancels it.
+			if err == nil && len(ranges) == 1 && ranges[0].start == int64(3*blockSize) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(10 * time.Second):
+				}
+				return
+			}
+		}
+		base(w, r)
+	}))
+	defer srv.Close()
+
+	r, err := NewPartialReaderAt(mustURL(t, srv.URL), WithConcurrency(2))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+
+	r.cache.Put(1, data[blockSize:2*blockSize])
+	r.cache.Put(2, data[2*blockSize:3*blockSize])
+
+	buf := make([]byte, len(data))
+	start := time.Now()
+	if _, err := r.ReadAt(buf, 0); err == nil {
+		t.Fatalf("ReadAt: expected an error, block 0's run never recovers")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("ReadAt: took %s, expected the failing run's error to return promptly", elapsed)
+	}
+}
+
+// TestNewPartialReaderAtHeadPath checks construction via a server that
+// answers HEAD normally, and that SupportsRanges reflects the
+// Accept-Ranges header actually observed there.
+func TestNewPartialReaderAtHeadPath(t *testing.T) {
+	data := []byte("hello, partial reader")
+
+	srv := httptest.NewServer(rangeHandler(data, "v1"))
+	defer srv.Close()
+
+	r, err := NewPartialReaderAt(mustURL(t, srv.URL))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+	if r.Size != int64(len(data)) {
+		t.Fatalf("Size = %d, want %d", r.Size, len(data))
+	}
+	if !r.SupportsRanges() {
+		t.Fatalf("SupportsRanges() = false, want true (HEAD advertised Accept-Ranges)")
+	}
+}
+
+// TestNewPartialReaderAtProbeFallback checks construction against a
+// server that rejects HEAD outright, forcing the bytes=0-0 probe GET
+// path, and that a probe response without an Accept-Ranges header is
+// reported honestly by SupportsRanges even though construction still
+// succeeds on the strength of the 206 itself.
+func TestNewPartialReaderAtProbeFallback(t *testing.T) {
+	data := []byte("hello, partial reader")
+
+	base := rangeHandler(data, "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Del("Accept-Ranges")
+		base(w, r)
+	}))
+	defer srv.Close()
+
+	r, err := NewPartialReaderAt(mustURL(t, srv.URL))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+	if r.Size != int64(len(data)) {
+		t.Fatalf("Size = %d, want %d", r.Size, len(data))
+	}
+	if r.SupportsRanges() {
+		t.Fatalf("SupportsRanges() = true, want false (probe response carried no Accept-Ranges header)")
+	}
+}
+
+// TestReadAtStaleIfRangeReturnsErrResourceChanged checks that a
+// single-range request whose If-Range validator the server rejects
+// (by answering 200 instead of 206) is reported as ErrResourceChanged,
+// not misread as unsupported multi-range.
+func TestReadAtStaleIfRangeReturnsErrResourceChanged(t *testing.T) {
+	data := make([]byte, blockSize)
+	fillTestData(data)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			rangeHandler(data, "v1")(w, r)
+			return
+		}
+		if r.Header.Get("If-Range") != "" && r.Header.Get("If-Range") != "v1" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+			return
+		}
+		rangeHandler(data, "v1")(w, r)
+	}))
+	defer srv.Close()
+
+	r, err := NewPartialReaderAt(mustURL(t, srv.URL))
+	if err != nil {
+		t.Fatalf("NewPartialReaderAt: %v", err)
+	}
+	r.ifRangeValue = "v2" // simulate the resource having changed since construction
+
+	buf := make([]byte, len(data))
+	_, err = r.ReadAt(buf, 0)
+	if !errors.Is(err, ErrResourceChanged) {
+		t.Fatalf("ReadAt: got err %v, want ErrResourceChanged", err)
+	}
+}